@@ -1,20 +1,36 @@
 package routeros
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // A reply can contain multiple pairs. A pair is a string key->value.
 // A reply can also contain subpairs, that is, a array of pair arrays.
+//
+// Done is set on the command's final event: its "!done" sentence, or the
+// error that ended the connection under it. Err carries the failure, if
+// any (a *TrapError, a *FatalError or a transport error), and Traps
+// accumulates every TrapError seen for a
+// query-style command that reports per-row failures ("!re"+"!trap"
+// interleaved) before its final "!done".
+// CallContext/QueryContext/KeepAliveCallContext consume these fields
+// internally so most callers never see a partial Reply.
 type Reply struct {
 	Pairs    []Pair
 	SubPairs []map[string]string
+	Done     bool
+	Err      error
+	Traps    []*TrapError
 }
 
 func (r *Reply) GetPairVal(key string) (string, error) {
@@ -46,18 +62,79 @@ func GetPairVal(pairs []Pair, key string) (string, error) {
 	return "", errors.New("key not found")
 }
 
+// Dialer controls how a Client establishes its underlying connection. The
+// embedded net.Dialer is used to open the TCP socket (honoring its Timeout
+// and Context-aware DialContext); when TLSConfig is non-nil the connection
+// is additionally wrapped with tls.Client, which is what RouterOS calls
+// API-SSL and normally serves on port 8729.
+type Dialer struct {
+	net.Dialer
+	TLSConfig *tls.Config
+}
+
 // Client is a RouterOS API client.
 type Client struct {
 	// Network Address.
 	// E.g. "10.0.0.1:8728" or "router.example.com:8728"
-	address  string
-	user     string
-	password string
-	debug    bool     // debug logging enabled
-	ready    bool     // Ready for work (login ok and connection not terminated)
-	conn     net.Conn // Connection to pass around
+	address    string
+	user       string
+	password   string
+	debug      bool       // debug logging enabled
+	ready      bool       // Ready for work (login ok and connection not terminated)
+	dialer     Dialer     // how to establish conn, optionally over TLS (API-SSL)
+	authMethod AuthMethod // which /login handshake Connect(Context) uses
+
+	writeMu     sync.Mutex  // serializes whole sentences onto conn for concurrent CallAsync callers
+	closed      atomic.Bool // set once dispatchLoop sees the connection die; makes new calls fail fast instead of hanging
+	tagSeq      uint64
+	listenersMu sync.Mutex
+	listeners   map[string]*listener
+
+	// connMu is the single lock for everything about "which connection,
+	// which generation, and has its dispatcher started": conn,
+	// generation and dispatchStarted are never read or written without
+	// it, by ConnectContext, Close, send/sendSentence, startDispatch,
+	// dispatchLoop or fail.
+	//
+	// ConnectContext bumps generation and swaps in the new conn in one
+	// critical section, with the bump happening first. That ordering is
+	// what stops a stale dispatchLoop that's concurrently unwinding (it
+	// already failed a read on the old conn and is calling fail with the
+	// old generation) from ever closing the connection that superseded
+	// it: by the time fail can observe the bumped generation, the new
+	// conn is already published, so it sees the mismatch and no-ops
+	// instead of racing ConnectContext to close() it.
+	//
+	// dispatchStarted records the generation startDispatch has already
+	// launched dispatchLoop for, which is the same guard sync.Once gives
+	// within one generation - but, unlike a sync.Once, lets ConnectContext
+	// hand a new generation a fresh "not yet started" state under the
+	// same lock startDispatch itself takes, rather than needing to
+	// unsynchronized-reset a shared Once value out from under a
+	// concurrent caller's Do.
+	connMu          sync.Mutex
+	conn            net.Conn
+	generation      uint64
+	dispatchStarted uint64
 }
 
+// AuthMethod selects which /login handshake Connect and ConnectContext use.
+type AuthMethod int
+
+const (
+	// AuthAuto tries the legacy MD5 challenge/response handshake used by
+	// RouterOS before 6.43, and falls back to the plain name/password
+	// handshake introduced in 6.43 when the router's first /login reply
+	// carries no "ret" challenge. This is the default.
+	AuthAuto AuthMethod = iota
+	// AuthLegacy forces the pre-6.43 MD5 challenge/response handshake,
+	// failing if the router doesn't return a challenge.
+	AuthLegacy
+	// AuthPlain forces the RouterOS 6.43+ handshake, sending name and
+	// password in a single /login call with no challenge round trip.
+	AuthPlain
+)
+
 // Pair is a Key-Value pair for RouterOS Attribute, Query, and Reply words
 // use slices of pairs instead of map because we care about order
 type Pair struct {
@@ -87,6 +164,14 @@ func NewPair(key string, value string) *Pair {
 
 // Create a new instance of the RouterOS API client
 func New(address string) (*Client, error) {
+	return NewWithDialer(address, Dialer{})
+}
+
+// NewWithDialer creates a new instance of the RouterOS API client using the
+// given Dialer. Set Dialer.TLSConfig to connect over API-SSL (usually port
+// 8729), and Dialer.Dialer to customize the underlying TCP dial (timeouts,
+// local address, etc).
+func NewWithDialer(address string, dialer Dialer) (*Client, error) {
 	// basic validation of host address
 	_, _, err := net.SplitHostPort(address)
 	if err != nil {
@@ -95,34 +180,109 @@ func New(address string) (*Client, error) {
 
 	var c Client
 	c.address = address
+	c.dialer = dialer
 
 	return &c, nil
 }
 
+// Close closes the underlying connection and marks the Client dead, so any
+// call already waiting on a reply is unblocked by dispatchLoop's own read
+// error (from the now-closed conn) and any new call fails fast instead of
+// hanging. Reconnect with Connect(Context).
 func (c *Client) Close() {
-	c.conn.Close()
+	c.closed.Store(true)
+	c.getConn().Close()
+}
+
+// getConn returns the current conn under connMu.
+func (c *Client) getConn() net.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
+// swapConn installs a freshly-dialed conn as the current one (see the
+// connMu field comment for why the generation bump and the swap happen
+// together, in that order) and returns the new generation.
+func (c *Client) swapConn(conn net.Conn) uint64 {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.generation++
+	c.conn = conn
+	return c.generation
+}
+
+// SetAuthMethod overrides how Connect and ConnectContext authenticate.
+// The default, AuthAuto, detects which handshake the router expects.
+func (c *Client) SetAuthMethod(m AuthMethod) {
+	c.authMethod = m
 }
 
+// Connect dials the router and logs in, equivalent to calling
+// ConnectContext with context.Background().
 func (c *Client) Connect(user string, password string) error {
-	conn, err := net.Dial("tcp", c.address)
+	return c.ConnectContext(context.Background(), user, password)
+}
+
+// ConnectContext dials the router (honoring ctx for both the TCP dial and
+// the login handshake) and logs in with user/password. If ctx has a
+// deadline, it is applied to the underlying connection for the duration of
+// the login exchange.
+func (c *Client) ConnectContext(ctx context.Context, user string, password string) error {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.address)
 	if err != nil {
 		return err
 	}
 
-	// stash conn in instance
-	c.conn = conn
+	if c.dialer.TLSConfig != nil {
+		conn = tls.Client(conn, c.dialer.TLSConfig)
+	}
+
+	// This may be a reconnect after a previous dispatchLoop exited (a
+	// transport error or "!fatal"). Any tag still outstanding from before
+	// belongs to that dispatcher, which is going away: broadcast it a
+	// terminal error before swapConn moves on, so a caller parked in
+	// collect/KeepAliveCallContext with no ctx deadline of its own sees an
+	// error instead of hanging forever on a tag nothing will ever deliver
+	// to again.
+	c.broadcast(Reply{Err: errReconnected, Done: true})
+	c.swapConn(conn)
+	c.closed.Store(false)
+
+	// A single goroutine owns reads off conn from here on, dispatching
+	// replies to whichever tag requested them; it must be running before
+	// we send /login.
+	c.startDispatch()
+
+	return c.login(ctx, user, password)
+}
+
+// login runs the /login handshake selected by c.authMethod over the
+// connection ConnectContext just established. Split out from
+// ConnectContext so it can be exercised without a real dial.
+func (c *Client) login(ctx context.Context, user string, password string) error {
+	// RouterOS 6.43+ accepts name/password directly in a single /login
+	// call, with no challenge round trip.
+	if c.authMethod == AuthPlain {
+		return c.loginPlain(ctx, user, password)
+	}
 
 	// try to log in
-	res, err := c.Call("/login", nil)
+	res, err := c.CallContext(ctx, "/login", nil)
 	if err != nil {
 		return err
 	}
 
-	// handle challenge/response
+	// Pre-6.43 routers challenge us with "ret"; 6.43+ routers reply with
+	// no "ret" at all and expect a plain name/password login instead.
 	challengeEnc, err := res.GetPairVal("ret")
 	if err != nil {
-		return errors.New("Didn't get challenge from ROS")
+		if c.authMethod == AuthLegacy {
+			return errors.New("Didn't get challenge from ROS")
+		}
+		return c.loginPlain(ctx, user, password)
 	}
+
 	challenge, err := hex.DecodeString(challengeEnc)
 	if err != nil {
 		return err
@@ -137,7 +297,7 @@ func (c *Client) Connect(user string, password string) error {
 	loginParams = append(loginParams, *NewPair("response", resp))
 
 	// try to log in again with challenge/response
-	res, err = c.Call("/login", loginParams)
+	res, err = c.CallContext(ctx, "/login", loginParams)
 	if err != nil {
 		return err
 	}
@@ -149,112 +309,225 @@ func (c *Client) Connect(user string, password string) error {
 	return nil
 }
 
-func (c *Client) Query(command string, q Query) (Reply, error) {
-	err := c.send(command)
+// loginPlain authenticates using the RouterOS 6.43+ scheme: a single
+// /login call carrying name and password directly, with no challenge.
+func (c *Client) loginPlain(ctx context.Context, user string, password string) error {
+	var loginParams []Pair
+	loginParams = append(loginParams, *NewPair("name", user))
+	loginParams = append(loginParams, *NewPair("password", password))
+
+	res, err := c.CallContext(ctx, "/login", loginParams)
 	if err != nil {
-		return Reply{}, err
+		return err
 	}
 
-	// Set property list if present
-	if len(q.Proplist) > 0 {
-		proplist := fmt.Sprintf("=.proplist=%s", strings.Join(q.Proplist, ","))
-		err = c.send(proplist)
-		if err != nil {
-			return Reply{}, err
-		}
+	if len(res.Pairs) > 0 {
+		return fmt.Errorf("Unexpected result on login: %+v", res)
 	}
 
-	// send params if we got them
-	if len(q.Pairs) > 0 {
-		for _, v := range q.Pairs {
-			word := fmt.Sprintf("?%s%s=%s", v.Op, v.Key, v.Value)
-			c.send(word)
-		}
+	return nil
+}
 
-		if q.Op != "" {
-			word := fmt.Sprintf("?#%s", q.Op)
-			c.send(word)
-		}
-	}
+// CallAsync sends command/params tagged with a fresh, unique tag and
+// returns immediately. Replies for that tag (each a "!re" row, a "!trap"
+// as a *TrapError, or the final "!done") are delivered on ch as they
+// arrive off the wire; cancel
+// sends "/cancel" for this tag so a long-running command (e.g. a listen)
+// can be stopped. Unlike Call/Query/KeepAliveCall, CallAsync lets several
+// commands run concurrently over the same connection.
+func (c *Client) CallAsync(command string, params []Pair) (string, <-chan Reply, func() error, error) {
+	return c.CallAsyncContext(context.Background(), command, params)
+}
 
-	// send terminator
-	err = c.send("")
-	if err != nil {
-		return Reply{}, err
-	}
+// CallAsyncContext is CallAsync with an explicit context, applied as a
+// deadline to the underlying connection while the request is sent.
+func (c *Client) CallAsyncContext(ctx context.Context, command string, params []Pair) (string, <-chan Reply, func() error, error) {
+	return c.callAsyncWords(ctx, command, paramWords(params))
+}
 
-	res, err := c.receive()
-	if err != nil {
-		return Reply{}, err
+// callAsyncWords is the shared plumbing behind CallAsync, Query and
+// KeepAliveCall: it starts the dispatcher if needed, allocates a tag,
+// sends the sentence, and returns the channel replies for that tag will
+// arrive on.
+func (c *Client) callAsyncWords(ctx context.Context, command string, words []string) (string, <-chan Reply, func() error, error) {
+	if c.closed.Load() {
+		return "", nil, nil, errConnClosed
 	}
 
-	return res, nil
-}
+	c.startDispatch()
 
-func (c *Client) KeepAliveCall(command string, q Query, iterator PairIterator) error {
-	err := c.send(command)
-	if err != nil {
-		return err
+	tag := c.nextTag()
+	ch := c.registerTag(tag, command, deadline(ctx))
+
+	if err := c.sendSentence(ctx, command, words, tag); err != nil {
+		// Don't unregister tag ourselves: unregisterTag closes ch, which
+		// would race a concurrent broadcast's deliver to the same tag.
+		// send closes conn only after a partial write, so the tag can stay
+		// registered until the connection fails or ConnectContext
+		// reconnects; drain ch in the background so that broadcast never
+		// blocks on a channel nobody reads.
+		c.abandon(ch)
+		return "", nil, nil, err
 	}
 
-	// Set property list if present
-	if len(q.Proplist) > 0 {
-		proplist := fmt.Sprintf("=.proplist=%s", strings.Join(q.Proplist, ","))
-		err = c.send(proplist)
-		if err != nil {
-			return err
-		}
+	cancel := func() error {
+		return c.sendSentence(context.Background(), "/cancel", []string{"=tag=" + tag}, "")
 	}
 
-	// send params if we got them
-	if len(q.Pairs) > 0 {
-		for _, v := range q.Pairs {
-			word := fmt.Sprintf("%s%s=%s", v.Op, v.Key, v.Value)
-			c.send(word)
+	return tag, ch, cancel, nil
+}
+
+// collect reads events off ch until the terminal "!done" event (or an
+// error, or ctx expiring), aggregating "!re" rows and "!done" pairs into
+// a single Reply the way Call and Query have always returned one. A
+// *TrapError doesn't stop the aggregation by itself (a query-style
+// command can report "!re"+"!trap" per row and keep going) - it's
+// collected into out.Traps, and only surfaced as the returned error once
+// "!done" arrives with no further sentences to wait for. A *FatalError or
+// transport error is terminal and returned immediately.
+func (c *Client) collect(ctx context.Context, ch <-chan Reply) (Reply, error) {
+	var out Reply
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return out, errors.New("connection closed")
+			}
+			out.Pairs = append(out.Pairs, ev.Pairs...)
+			out.SubPairs = append(out.SubPairs, ev.SubPairs...)
+			if trap, ok := ev.Err.(*TrapError); ok {
+				out.Traps = append(out.Traps, trap)
+			} else if ev.Err != nil {
+				return out, ev.Err
+			}
+			if ev.Done {
+				if len(out.Traps) > 0 {
+					return out, out.Traps[0]
+				}
+				return out, nil
+			}
+		case <-ctx.Done():
+			// dispatchLoop still owns ch and will deliver this tag's
+			// remaining events (up to its eventual "!done"); drain them
+			// in the background so it never blocks on a reply nobody's
+			// reading anymore.
+			c.abandon(ch)
+			return out, ctx.Err()
 		}
 	}
+}
+
+func (c *Client) Query(command string, q Query) (Reply, error) {
+	return c.QueryContext(context.Background(), command, q)
+}
 
-	// send terminator
-	err = c.send("")
+func (c *Client) QueryContext(ctx context.Context, command string, q Query) (Reply, error) {
+	_, ch, _, err := c.callAsyncWords(ctx, command, queryWords(q))
 	if err != nil {
-		return err
+		return Reply{}, err
 	}
+	return c.collect(ctx, ch)
+}
 
-	err = c.asyncReceive(func(reply Reply, err error) {
-		iterator(reply.SubPairs, err)
-	})
+func (c *Client) KeepAliveCall(command string, q Query, iterator PairIterator) error {
+	return c.KeepAliveCallContext(context.Background(), command, q, iterator)
+}
 
+// KeepAliveCallContext runs a long-lived "listen"-style command, invoking
+// iterator with each "!re" row as it arrives. A *TrapError is reported to
+// iterator like any other row but, matching QueryContext, doesn't end the
+// listen by itself - only "!done" (normally once cancel is called because
+// ctx expired) or a *FatalError/transport error does.
+func (c *Client) KeepAliveCallContext(ctx context.Context, command string, q Query, iterator PairIterator) error {
+	_, ch, cancel, err := c.callAsyncWords(ctx, command, keepAliveWords(q))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if len(ev.SubPairs) > 0 || ev.Err != nil {
+				iterator(ev.SubPairs, ev.Err)
+			}
+			if _, isTrap := ev.Err.(*TrapError); ev.Err != nil && !isTrap {
+				return ev.Err
+			}
+			if ev.Done {
+				return nil
+			}
+		case <-ctx.Done():
+			cerr := cancel()
+			// dispatchLoop will still deliver this tag's remaining events
+			// (up to whatever "!done" the /cancel eventually produces);
+			// drain them in the background so it never blocks.
+			c.abandon(ch)
+			if cerr != nil {
+				return cerr
+			}
+			return ctx.Err()
+		}
+	}
 }
 
 func (c *Client) Call(command string, params []Pair) (Reply, error) {
-	err := c.send(command)
+	return c.CallContext(context.Background(), command, params)
+}
+
+func (c *Client) CallContext(ctx context.Context, command string, params []Pair) (Reply, error) {
+	_, ch, _, err := c.callAsyncWords(ctx, command, paramWords(params))
 	if err != nil {
 		return Reply{}, err
 	}
+	return c.collect(ctx, ch)
+}
 
-	// send params if we got them
-	if len(params) > 0 {
-		for _, v := range params {
-			word := fmt.Sprintf("=%s=%s", v.Key, v.Value)
-			c.send(word)
-		}
+// paramWords renders Call-style params ("=key=value") into wire words.
+func paramWords(params []Pair) []string {
+	words := make([]string, 0, len(params))
+	for _, v := range params {
+		words = append(words, fmt.Sprintf("=%s=%s", v.Key, v.Value))
 	}
+	return words
+}
 
-	// send terminator
-	err = c.send("")
-	if err != nil {
-		return Reply{}, err
+// queryWords renders a Query's proplist and filter pairs into wire words.
+func queryWords(q Query) []string {
+	var words []string
+
+	if len(q.Proplist) > 0 {
+		words = append(words, fmt.Sprintf("=.proplist=%s", strings.Join(q.Proplist, ",")))
 	}
 
-	res, err := c.receive()
-	if err != nil {
-		return Reply{}, err
+	for _, v := range q.Pairs {
+		words = append(words, fmt.Sprintf("?%s%s=%s", v.Op, v.Key, v.Value))
+	}
+
+	if q.Op != "" {
+		words = append(words, fmt.Sprintf("?#%s", q.Op))
+	}
+
+	return words
+}
+
+// keepAliveWords renders a Query's proplist and filter pairs into wire
+// words for KeepAliveCall(Context). Unlike queryWords, filter pairs carry
+// no leading "?" and q.Op is not sent at all - that's the wire format
+// KeepAliveCall used before it was built on callAsyncWords, and it is
+// kept unchanged.
+func keepAliveWords(q Query) []string {
+	var words []string
+
+	if len(q.Proplist) > 0 {
+		words = append(words, fmt.Sprintf("=.proplist=%s", strings.Join(q.Proplist, ",")))
+	}
+
+	for _, v := range q.Pairs {
+		words = append(words, fmt.Sprintf("%s%s=%s", v.Op, v.Key, v.Value))
 	}
 
-	return res, nil
+	return words
 }
@@ -0,0 +1,224 @@
+package routeros
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readRouterSentence reads one sentence off conn the way dispatchLoop
+// would, for tests playing the router side of a fake connection.
+func readRouterSentence(conn net.Conn) (sentence, error) {
+	var c Client
+	return c.readSentence(conn)
+}
+
+// writeSentence writes kind, each pair as "=key=value", an optional .tag
+// word and the terminating empty word onto conn - the wire format tests
+// use to script a fake router's responses.
+func writeSentence(conn net.Conn, kind string, tag string, pairs ...Pair) error {
+	words := []string{kind}
+	for _, p := range pairs {
+		words = append(words, fmt.Sprintf("=%s=%s", p.Key, p.Value))
+	}
+	if tag != "" {
+		words = append(words, ".tag="+tag)
+	}
+	words = append(words, "")
+
+	for _, w := range words {
+		if _, err := conn.Write(prefixlen(int64(len(w))).Bytes()); err != nil {
+			return err
+		}
+		if len(w) == 0 {
+			// A zero-length word (the terminator) has no payload on the
+			// wire at all - readLen returns as soon as it decodes the
+			// length itself - so there's nothing to write here, and a
+			// zero-byte Write would just wait forever for a Read that
+			// will never come.
+			continue
+		}
+		if _, err := conn.Write([]byte(w)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateTestTLSCert returns a short-lived, self-signed certificate for
+// 127.0.0.1, good enough to exercise a real tls.Listen/tls.Client
+// handshake in tests without shipping a fixture cert that could expire.
+func generateTestTLSCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load keypair: %v", err)
+	}
+	return cert
+}
+
+// TestConnectContextDialsOverTLS exercises Dialer.TLSConfig end to end: a
+// real tls.Listen accepts the dial, meaning ConnectContext's tls.Client
+// wrap actually completed a TLS handshake before the /login exchange
+// (scripted with AuthPlain) could succeed.
+func TestConnectContextDialsOverTLS(t *testing.T) {
+	cert := generateTestTLSCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		s, err := readRouterSentence(conn)
+		if err != nil || s.kind != "/login" {
+			return
+		}
+		writeSentence(conn, "!done", s.tag)
+	}()
+
+	c, err := NewWithDialer(ln.Addr().String(), Dialer{TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+	if err != nil {
+		t.Fatalf("NewWithDialer: %v", err)
+	}
+	c.SetAuthMethod(AuthPlain)
+
+	if err := c.ConnectContext(context.Background(), "admin", "secret"); err != nil {
+		t.Fatalf("ConnectContext over TLS = %v, want nil", err)
+	}
+}
+
+// TestLoginAutoFallsBackToPlainWhenNoChallenge covers AuthAuto's branch:
+// when the router's first /login reply carries no "ret" challenge, it
+// must retry with a plain name/password /login rather than erroring out.
+func TestLoginAutoFallsBackToPlainWhenNoChallenge(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	var c Client
+	c.swapConn(clientConn)
+	c.startDispatch()
+
+	done := make(chan error, 1)
+	go func() { done <- c.login(context.Background(), "admin", "secret") }()
+
+	s, err := readRouterSentence(serverConn)
+	if err != nil || s.kind != "/login" {
+		t.Fatalf("first sentence = %+v, %v, want /login", s, err)
+	}
+	if err := writeSentence(serverConn, "!done", s.tag); err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := readRouterSentence(serverConn)
+	if err != nil || s2.kind != "/login" {
+		t.Fatalf("second sentence = %+v, %v, want /login", s2, err)
+	}
+	name, _ := GetPairVal(s2.pairs, "name")
+	password, _ := GetPairVal(s2.pairs, "password")
+	if name != "admin" || password != "secret" {
+		t.Fatalf("plain login params = name=%q password=%q, want admin/secret", name, password)
+	}
+	if err := writeSentence(serverConn, "!done", s2.tag); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("login() = %v, want nil", err)
+	}
+}
+
+// TestLoginLegacyRejectsMissingChallenge covers AuthLegacy's branch: it
+// must not fall back to a plain login when the router doesn't challenge
+// it, but fail outright.
+func TestLoginLegacyRejectsMissingChallenge(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	var c Client
+	c.SetAuthMethod(AuthLegacy)
+	c.swapConn(clientConn)
+	c.startDispatch()
+
+	done := make(chan error, 1)
+	go func() { done <- c.login(context.Background(), "admin", "secret") }()
+
+	s, err := readRouterSentence(serverConn)
+	if err != nil || s.kind != "/login" {
+		t.Fatalf("sentence = %+v, %v, want /login", s, err)
+	}
+	if err := writeSentence(serverConn, "!done", s.tag); err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-done
+	if err == nil || err.Error() != "Didn't get challenge from ROS" {
+		t.Fatalf("login() = %v, want %q", err, "Didn't get challenge from ROS")
+	}
+}
+
+// TestKeepAliveWordsMatchesOriginalFormat guards against KeepAliveCall
+// silently picking up Query's wire format: unlike queryWords, it must not
+// prefix filter words with "?" or send q.Op.
+func TestKeepAliveWordsMatchesOriginalFormat(t *testing.T) {
+	q := Query{
+		Proplist: []string{"name"},
+		Pairs:    []Pair{{Key: "type", Value: "ether"}},
+		Op:       "|",
+	}
+
+	got := keepAliveWords(q)
+	want := []string{"=.proplist=name", "type=ether"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("keepAliveWords(%+v) = %v, want %v", q, got, want)
+	}
+
+	gotQuery := queryWords(q)
+	wantQuery := []string{"=.proplist=name", "?type=ether", "?#|"}
+	if !reflect.DeepEqual(gotQuery, wantQuery) {
+		t.Errorf("queryWords(%+v) = %v, want %v", q, gotQuery, wantQuery)
+	}
+}
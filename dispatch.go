@@ -0,0 +1,217 @@
+package routeros
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// listener is what a tag is waiting on: the channel its Reply events are
+// delivered to, the command that was sent under that tag (needed to
+// annotate a TrapError when one arrives), and the deadline (if any) of the
+// ctx that registered it - dispatchLoop's shared read uses the earliest of
+// these across all listeners, so a caller's ctx actually bounds the I/O and
+// not just that caller's local wait.
+type listener struct {
+	ch       chan Reply
+	command  string
+	deadline time.Time
+}
+
+// startDispatch starts the single goroutine that reads sentences off conn
+// and routes them to whichever tag requested them, once per connection
+// generation (see the connMu field comment for why dispatchStarted, not a
+// sync.Once, is what makes this idempotent). It is safe to call
+// repeatedly; only the first call for the current generation has any
+// effect.
+func (c *Client) startDispatch() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.dispatchStarted == c.generation {
+		return
+	}
+	c.dispatchStarted = c.generation
+	go c.dispatchLoop()
+}
+
+// nextTag returns a fresh, unique tag for a new outgoing sentence.
+func (c *Client) nextTag() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.tagSeq, 1), 10)
+}
+
+// registerTag creates and records the channel a tag's replies will be
+// delivered on, remembering command for later TrapErrors and dl (the
+// registering ctx's deadline, or the zero Time for none) for nextDeadline.
+func (c *Client) registerTag(tag, command string, dl time.Time) chan Reply {
+	ch := make(chan Reply)
+
+	c.listenersMu.Lock()
+	if c.listeners == nil {
+		c.listeners = make(map[string]*listener)
+	}
+	c.listeners[tag] = &listener{ch: ch, command: command, deadline: dl}
+	c.listenersMu.Unlock()
+
+	return ch
+}
+
+// nextDeadline returns the earliest deadline still in the future among all
+// currently-registered listeners, or the zero Time (no deadline) if none
+// has one. Deadlines that have already passed are skipped, so a listener
+// whose caller stopped waiting doesn't make every later read time out at
+// once. dispatchLoop applies this to its shared read so a caller's ctx
+// bounds the underlying I/O, not just that caller's local wait on its
+// channel.
+func (c *Client) nextDeadline() time.Time {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+
+	now := time.Now()
+	var dl time.Time
+	for _, l := range c.listeners {
+		if l.deadline.IsZero() || !l.deadline.After(now) {
+			continue
+		}
+		if dl.IsZero() || l.deadline.Before(dl) {
+			dl = l.deadline
+		}
+	}
+	return dl
+}
+
+// unregisterTag stops a tag's replies from being delivered and closes its
+// channel. Only dispatchLoop calls this, so it never races with deliver.
+func (c *Client) unregisterTag(tag string) {
+	c.listenersMu.Lock()
+	l, ok := c.listeners[tag]
+	delete(c.listeners, tag)
+	c.listenersMu.Unlock()
+
+	if ok {
+		close(l.ch)
+	}
+}
+
+// listener looks up the listener registered for tag, if any.
+func (c *Client) listener(tag string) *listener {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	return c.listeners[tag]
+}
+
+// deliver routes one event to the channel registered for tag, if any.
+func (c *Client) deliver(tag string, r Reply) {
+	if l := c.listener(tag); l != nil {
+		l.ch <- r
+	}
+}
+
+// abandon lets a caller stop reading ch (because its context expired)
+// without blocking dispatchLoop, which still owns the tag until it sees
+// that tag's "!done" (or the connection itself ends) and unregisters it.
+// Until then, deliver keeps sending to ch; draining it here in the
+// background is what keeps dispatchLoop from wedging on an abandoned tag.
+func (c *Client) abandon(ch <-chan Reply) {
+	go func() {
+		for range ch {
+		}
+	}()
+}
+
+// fail tears the connection down after it's no longer usable - a transport
+// error reading off it, or a "!fatal" sentence - marking the Client dead
+// (so callAsyncWords/sendSentence fail fast instead of hanging a new call
+// on a socket nobody is reading from anymore) and broadcasting err to every
+// tag still waiting on a reply. gen is the generation dispatchLoop read
+// conn under; see the connMu field comment for why comparing it against
+// the current generation under the same lock is what lets a stale
+// dispatchLoop's fail no-op instead of closing a connection that has
+// since been replaced.
+func (c *Client) fail(gen uint64, err error) {
+	c.connMu.Lock()
+	if c.generation != gen {
+		c.connMu.Unlock()
+		return
+	}
+	conn := c.conn
+	c.connMu.Unlock()
+
+	c.closed.Store(true)
+	conn.Close()
+	c.broadcast(Reply{Err: err, Done: true})
+}
+
+// dispatchLoop owns reads off conn for the lifetime of the connection. It
+// parses one sentence at a time and forwards it, as a Reply event, to the
+// channel registered for that sentence's tag. conn and gen are captured
+// together, under connMu, once at the top: this loop only ever reads this
+// one conn, so nothing later in the loop needs to re-take connMu to see it.
+func (c *Client) dispatchLoop() {
+	c.connMu.Lock()
+	gen := c.generation
+	conn := c.conn
+	c.connMu.Unlock()
+
+	for {
+		if err := conn.SetReadDeadline(c.nextDeadline()); err != nil {
+			c.fail(gen, err)
+			return
+		}
+
+		s, err := c.readSentence(conn)
+		if err != nil {
+			// A deadline here belongs to whichever listener(s) it was
+			// computed from, not to the connection itself - collect/
+			// KeepAliveCallContext already return on their own ctx.Done()
+			// independently of this read. Loop around and recompute the
+			// next deadline rather than tearing down the connection for
+			// every other, unrelated in-flight caller.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			c.fail(gen, err)
+			return
+		}
+
+		switch s.kind {
+		case "!re":
+			row := make(map[string]string, len(s.pairs))
+			for _, p := range s.pairs {
+				row[p.Key] = p.Value
+			}
+			c.deliver(s.tag, Reply{SubPairs: []map[string]string{row}})
+
+		case "!done":
+			c.deliver(s.tag, Reply{Pairs: s.pairs, Done: true})
+			c.unregisterTag(s.tag)
+
+		case "!trap":
+			if l := c.listener(s.tag); l != nil {
+				c.deliver(s.tag, Reply{Err: trapError(l.command, s.pairs)})
+			}
+
+		case "!fatal":
+			c.ready = false
+			c.fail(gen, fatalError(s.pairs))
+			return
+		}
+	}
+}
+
+// broadcast delivers r to every tag currently awaiting a reply, then
+// unregisters them; used when the connection itself is gone (on read
+// error or !fatal).
+func (c *Client) broadcast(r Reply) {
+	c.listenersMu.Lock()
+	tags := make([]string, 0, len(c.listeners))
+	for tag := range c.listeners {
+		tags = append(tags, tag)
+	}
+	c.listenersMu.Unlock()
+
+	for _, tag := range tags {
+		c.deliver(tag, r)
+		c.unregisterTag(tag)
+	}
+}
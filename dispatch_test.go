@@ -0,0 +1,130 @@
+package routeros
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConn is a net.Conn whose only used method is Close; everything else
+// panics through the embedded nil net.Conn if a test accidentally calls it.
+type fakeConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (f *fakeConn) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+// TestFailNoopsOnStaleGeneration reproduces the race the generation guard
+// exists to prevent: a dispatchLoop that read gen before a reconnect must
+// not close the connection ConnectContext has since swapped in.
+func TestFailNoopsOnStaleGeneration(t *testing.T) {
+	var c Client
+
+	oldConn := &fakeConn{}
+	staleGen := c.swapConn(oldConn)
+
+	newConn := &fakeConn{}
+	c.swapConn(newConn)
+
+	c.fail(staleGen, errors.New("stale read error"))
+
+	if newConn.closed.Load() {
+		t.Fatal("fail closed the current connection on a stale generation")
+	}
+	if c.closed.Load() {
+		t.Fatal("fail marked the client dead on a stale generation")
+	}
+}
+
+// TestFailClosesCurrentGeneration is the counterpart: when gen still
+// matches, fail must close conn and mark the client dead.
+func TestFailClosesCurrentGeneration(t *testing.T) {
+	var c Client
+
+	conn := &fakeConn{}
+	gen := c.swapConn(conn)
+
+	c.fail(gen, errors.New("read error"))
+
+	if !conn.closed.Load() {
+		t.Fatal("fail did not close conn on a current generation")
+	}
+	if !c.closed.Load() {
+		t.Fatal("fail did not mark the client dead")
+	}
+}
+
+// TestDispatchLoopDeliversTrap covers dispatchLoop's "!trap" branch: it
+// must deliver a *TrapError annotated with the listener's command, and
+// keep the tag registered for the "!done" that follows (a query-style
+// command can report "!re"/"!trap" per row and keep going).
+func TestDispatchLoopDeliversTrap(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	var c Client
+	c.swapConn(clientConn)
+	c.startDispatch()
+
+	ch := c.registerTag("1", "/foo", time.Time{})
+
+	if err := writeSentence(serverConn, "!trap", "1", Pair{Key: "message", Value: "no such command"}, Pair{Key: "category", Value: "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-ch
+	trap, ok := r.Err.(*TrapError)
+	if !ok {
+		t.Fatalf("Err = %v (%T), want *TrapError", r.Err, r.Err)
+	}
+	if trap.Command != "/foo" || trap.Message != "no such command" || trap.Category != "2" {
+		t.Fatalf("trap = %+v, want command /foo, message %q, category 2", trap, "no such command")
+	}
+
+	if err := writeSentence(serverConn, "!done", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if r = <-ch; !r.Done {
+		t.Fatal("final Reply.Done = false, want true")
+	}
+}
+
+// TestDispatchLoopHandlesFatal covers dispatchLoop's "!fatal" branch: it
+// must broadcast a *FatalError to every outstanding tag and mark the
+// Client dead, rather than delivering only to whichever tag (if any) the
+// sentence names.
+func TestDispatchLoopHandlesFatal(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	var c Client
+	c.swapConn(clientConn)
+	c.startDispatch()
+
+	ch := c.registerTag("1", "/foo", time.Time{})
+
+	if err := writeSentence(serverConn, "!fatal", "", Pair{Key: "message", Value: "session terminated on request"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-ch
+	fatal, ok := r.Err.(*FatalError)
+	if !ok {
+		t.Fatalf("Err = %v (%T), want *FatalError", r.Err, r.Err)
+	}
+	if fatal.Message != "session terminated on request" {
+		t.Fatalf("fatal.Message = %q, want %q", fatal.Message, "session terminated on request")
+	}
+	if !r.Done {
+		t.Fatal("Reply.Done = false, want true")
+	}
+	if !c.closed.Load() {
+		t.Fatal("client not marked closed after !fatal")
+	}
+}
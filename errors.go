@@ -0,0 +1,65 @@
+package routeros
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errConnClosed is returned by callAsyncWords/sendSentence once dispatchLoop
+// has seen the connection die (a transport error or "!fatal"), so new calls
+// fail immediately instead of registering a tag and writing to a socket
+// nobody is reading from anymore.
+var errConnClosed = errors.New("routeros: connection closed")
+
+// errReconnected is delivered to any tag still outstanding when
+// ConnectContext reconnects over a previous connection, so a caller
+// blocked in collect/KeepAliveCallContext with no ctx deadline of its own
+// sees a terminal event instead of hanging forever on a tag the new
+// connection's dispatcher will never know about.
+var errReconnected = errors.New("routeros: client reconnected")
+
+// TrapError is returned when a command fails: the router answered it with
+// a "!trap" sentence instead of (or, for query-style commands, in
+// addition to) "!re"/"!done". Message and Category come from the
+// sentence's =message=/=category= pairs; Command is the command that
+// produced it.
+type TrapError struct {
+	Command  string
+	Message  string
+	Category string
+}
+
+func (e *TrapError) Error() string {
+	if e.Category != "" {
+		return fmt.Sprintf("routeros: %s: trap: %s (category %s)", e.Command, e.Message, e.Category)
+	}
+	return fmt.Sprintf("routeros: %s: trap: %s", e.Command, e.Message)
+}
+
+// FatalError is returned when the router closes the connection on its own
+// terms: it answered with a "!fatal" sentence, carrying Message from its
+// =message= pair. Once a FatalError is seen the Client is no longer
+// usable; callers must Connect(Context) again.
+type FatalError struct {
+	Message string
+}
+
+func (e *FatalError) Error() string {
+	if e.Message == "" {
+		return "routeros: fatal: connection closing"
+	}
+	return fmt.Sprintf("routeros: fatal: %s", e.Message)
+}
+
+// trapError builds a TrapError from a "!trap" sentence's pairs.
+func trapError(command string, pairs []Pair) *TrapError {
+	msg, _ := GetPairVal(pairs, "message")
+	category, _ := GetPairVal(pairs, "category")
+	return &TrapError{Command: command, Message: msg, Category: category}
+}
+
+// fatalError builds a FatalError from a "!fatal" sentence's pairs.
+func fatalError(pairs []Pair) *FatalError {
+	msg, _ := GetPairVal(pairs, "message")
+	return &FatalError{Message: msg}
+}
@@ -2,199 +2,227 @@
 package routeros
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"time"
 )
 
-// Encode and send a single line
-func (c *Client) send(word string) error {
-	bword := []byte(word)
-	prefix := prefixlen(int64(len(bword)))
+// deadline returns ctx's deadline, or the zero time.Time (meaning "no
+// deadline") if ctx has none.
+func deadline(ctx context.Context) time.Time {
+	if dl, ok := ctx.Deadline(); ok {
+		return dl
+	}
+	return time.Time{}
+}
 
-	_, err := c.conn.Write(prefix.Bytes())
-	if err != nil {
-		return err
+// prefixlen encodes l as a RouterOS API word length: 1 to 5 bytes, where
+// the leading bits of the first byte say how many more bytes follow (0,
+// 1, 2, 3 or, for the 0xF0 marker, always 4), matching the length
+// encoding RouterOS itself uses on the wire. readLen decodes it back.
+func prefixlen(l int64) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	switch {
+	case l < 0x80:
+		buf.WriteByte(byte(l))
+	case l < 0x4000:
+		l |= 0x8000
+		buf.WriteByte(byte(l >> 8))
+		buf.WriteByte(byte(l))
+	case l < 0x200000:
+		l |= 0xC00000
+		buf.WriteByte(byte(l >> 16))
+		buf.WriteByte(byte(l >> 8))
+		buf.WriteByte(byte(l))
+	case l < 0x10000000:
+		l |= 0xE0000000
+		buf.WriteByte(byte(l >> 24))
+		buf.WriteByte(byte(l >> 16))
+		buf.WriteByte(byte(l >> 8))
+		buf.WriteByte(byte(l))
+	default:
+		buf.WriteByte(0xF0)
+		buf.WriteByte(byte(l >> 24))
+		buf.WriteByte(byte(l >> 16))
+		buf.WriteByte(byte(l >> 8))
+		buf.WriteByte(byte(l))
+	}
+	return buf
+}
+
+// readLen decodes a single RouterOS API word length off conn, the
+// inverse of prefixlen. It's a free function rather than a Client method
+// so it reads off whichever conn readSentence was handed, not whatever
+// c.conn might have become since - the same reason readSentence itself
+// takes conn as a parameter.
+func readLen(conn net.Conn) (int64, error) {
+	var lead [1]byte
+	if _, err := io.ReadFull(conn, lead[:]); err != nil {
+		return 0, err
+	}
+
+	var tailLen int
+	var high int64
+	switch {
+	case lead[0]&0x80 == 0x00:
+		return int64(lead[0]), nil
+	case lead[0]&0xC0 == 0x80:
+		tailLen, high = 1, int64(lead[0]&^0xC0)
+	case lead[0]&0xE0 == 0xC0:
+		tailLen, high = 2, int64(lead[0]&^0xE0)
+	case lead[0]&0xF0 == 0xE0:
+		tailLen, high = 3, int64(lead[0]&^0xF0)
+	case lead[0] == 0xF0:
+		tailLen, high = 4, 0
+	default:
+		return 0, fmt.Errorf("invalid length prefix byte %#x", lead[0])
+	}
+
+	tail := make([]byte, tailLen)
+	if _, err := io.ReadFull(conn, tail); err != nil {
+		return 0, err
 	}
 
-	_, err = c.conn.Write(bword)
-	if err != nil {
+	length := high
+	for _, b := range tail {
+		length = length<<8 | int64(b)
+	}
+	return length, nil
+}
+
+// send encodes words and writes them as a single Write call, so a
+// deadline expiring mid-encode can't leave a half-written word on the
+// wire the way writing each word separately could. On a write error with
+// zero bytes written (e.g. a ctx that was already expired when writeMu
+// was finally acquired), nothing hit the wire, framing is intact, and
+// conn is left alone for whoever sends next. A partial write, though,
+// leaves the framing itself corrupted for any later sentence on conn, so
+// that case closes conn - dispatchLoop's next read will then observe the
+// close, fail, and broadcast the error to every other tag waiting on
+// this connection, the same as any other transport-fatal error.
+func (c *Client) send(ctx context.Context, words ...string) error {
+	conn := c.getConn()
+	if err := conn.SetWriteDeadline(deadline(ctx)); err != nil {
 		return err
 	}
 
-	return nil
+	var buf bytes.Buffer
+	for _, word := range words {
+		bword := []byte(word)
+		buf.Write(prefixlen(int64(len(bword))).Bytes())
+		buf.Write(bword)
+	}
+
+	n, err := conn.Write(buf.Bytes())
+	if err != nil && n > 0 {
+		conn.Close()
+	}
+	return err
 }
 
-// Get reply
-func (c *Client) receive() (Reply, error) {
-	var reply Reply
+// sentence is a single low-level RouterOS API sentence: a leading control
+// word ("!re", "!done", "!trap" or "!fatal"), zero or more "=key=value"
+// attribute words and an optional ".tag=" word, terminated by an empty
+// word. tag is stripped out of pairs since it identifies the sentence
+// rather than describing it.
+type sentence struct {
+	kind  string
+	tag   string
+	pairs []Pair
+}
 
-	re := false
-	done := false
-	subReply := make(map[string]string, 1)
+// readSentence reads a single sentence off conn. Its read deadline is set
+// by the caller (dispatchLoop, from nextDeadline) rather than here, since
+// one shared goroutine reads every sentence on behalf of all current
+// callers and no single one of their contexts should bound it alone. conn
+// is passed in rather than read off c.conn so dispatchLoop - the only
+// caller - keeps reading the one conn it started with for its whole
+// lifetime, even if ConnectContext swaps in a new one concurrently.
+func (c *Client) readSentence(conn net.Conn) (sentence, error) {
+	var s sentence
 	for {
-		length := c.getlen()
-		if length == 0 && done {
-			break
+		length, err := readLen(conn)
+		if err != nil {
+			return s, err
+		}
+		if length == 0 {
+			return s, nil
 		}
 
 		inbuf := make([]byte, length)
-		n, err := io.ReadAtLeast(c.conn, inbuf, int(length))
+		n, err := io.ReadAtLeast(conn, inbuf, int(length))
 		// We don't actually care about EOF, but things like ErrUnspectedEOF we would
 		if err != nil && err != io.EOF {
-			return reply, err
+			return s, err
 		}
 
 		// be annoying about reading exactly the correct number of bytes
 		if int64(n) != length {
-			return reply, fmt.Errorf("incorrect number of bytes read")
+			return s, fmt.Errorf("incorrect number of bytes read")
 		}
 
-		word := string(inbuf)
-		if word == "!done" {
-			done = true
-			continue
-		}
+		s = appendSentenceWord(s, string(inbuf))
+	}
+}
 
-		if word == "!re" { // new term so start a new pair
-			if len(subReply) > 0 {
-				// we've already used this subreply because it has stuff in it
-				// so we need to close it out and make a new one
-				reply.SubPairs = append(reply.SubPairs, subReply)
-				subReply = make(map[string]string, 1)
-			} else {
-				re = true
-			}
-			continue
-		}
+// appendSentenceWord classifies a single already-read word and folds it
+// into s: the first word is the sentence's kind, a ".tag=" word sets tag,
+// and any other "=key=value" word becomes a pair. It holds none of
+// readSentence's I/O, so it's trivial to unit test in isolation.
+func appendSentenceWord(s sentence, word string) sentence {
+	if s.kind == "" {
+		s.kind = word
+		return s
+	}
 
-		if strings.Contains(word, "=") {
-			parts := strings.SplitN(word, "=", 3)
-			var key, val string
-			if len(parts) == 3 {
-				key = parts[1]
-				val = parts[2]
-			} else {
-				key = parts[1]
-			}
-
-			if re {
-				if key != "" {
-					subReply[key] = val
-				}
-			} else {
-				var p Pair
-				p.Key = key
-				p.Value = val
-				reply.Pairs = append(reply.Pairs, p)
-			}
-		}
+	if strings.HasPrefix(word, ".tag=") {
+		s.tag = word[len(".tag="):]
+		return s
 	}
 
-	if len(subReply) > 0 {
-		reply.SubPairs = append(reply.SubPairs, subReply)
+	if strings.Contains(word, "=") {
+		parts := strings.SplitN(word, "=", 3)
+		var key, val string
+		if len(parts) == 3 {
+			key = parts[1]
+			val = parts[2]
+		} else {
+			key = parts[1]
+		}
+		s.pairs = append(s.pairs, Pair{Key: key, Value: val})
 	}
 
-	return reply, nil
+	return s
 }
 
-type AsyncReceiveIterator func(reply Reply, err error)
-
-func (c *Client) asyncReceive(iterator AsyncReceiveIterator) error {
-
-	//for {
-		var reply Reply
-
-		var counter int64 = 1
-
-		re := false
-		done := false
-
-		subReply := make(map[string]string, 1)
-
-		for {
-			counter += 1
-
-			if done {
-				break;
-			}
-
-			length := c.getlen()
-
-			inbuf := make([]byte, length)
-			n, err := io.ReadAtLeast(c.conn, inbuf, int(length))
-			// We don't actually care about EOF, but things like ErrUnspectedEOF we would
-			if err != nil && err != io.EOF {
-				return err
-			}
-
-			// be annoying about reading exactly the correct number of bytes
-			if int64(n) != length {
-				return fmt.Errorf("incorrect number of bytes read")
-			}
-
-			word := string(inbuf)
-			// fmt.Printf("%s\n", word)
-
-			if word == "!done" {
-				done = true
-				continue
-			}
-
-			if word == "" {
-				
-				if len(subReply) > 0 {
-					reply.SubPairs = append(reply.SubPairs, subReply)
-				}
-				iterator(reply, nil)
-
-				reply = Reply{}
-
-				re = false
-				done = false
-
-				subReply = make(map[string]string, 1)
-				continue
-			}
-
-			if word == "!re" { // new term so start a new pair
-				if len(subReply) > 0 {
-					// we've already used this subreply because it has stuff in it
-					// so we need to close it out and make a new one
-					reply.SubPairs = append(reply.SubPairs, subReply)
-					subReply = make(map[string]string, 1)
-				} else {
-					re = true
-				}
-				continue
-			}
-
-			if strings.Contains(word, "=") {
-				parts := strings.SplitN(word, "=", 3)
-				var key, val string
-				if len(parts) == 3 {
-					key = parts[1]
-					val = parts[2]
-				} else {
-					key = parts[1]
-				}
-
-				if re {
-					if key != "" {
-						subReply[key] = val
-					}
-				} else {
-					var p Pair
-					p.Key = key
-					p.Value = val
-					reply.Pairs = append(reply.Pairs, p)
-				}
-			}
+// sendSentence writes command, then each of words, then an optional .tag
+// word, then the empty terminating word, all as a single send so
+// concurrent CallAsync callers can't interleave their words on the wire.
+// It holds writeMu for the duration so send's one Write call is still the
+// whole sentence even when multiple goroutines share this Client. send
+// itself decides whether a failed write needs to take conn down with it
+// (see its doc comment): a caller whose ctx was already expired just gets
+// its own error back, instead of every other in-flight caller on the
+// same conn being torn down too.
+func (c *Client) sendSentence(ctx context.Context, command string, words []string, tag string) error {
+	if c.closed.Load() {
+		return errConnClosed
+	}
 
-		}
+	all := make([]string, 0, len(words)+3)
+	all = append(all, command)
+	all = append(all, words...)
+	if tag != "" {
+		all = append(all, ".tag="+tag)
+	}
+	all = append(all, "")
 
-		
-	//}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 
-	return nil
+	return c.send(ctx, all...)
 }
@@ -0,0 +1,79 @@
+package routeros
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedConn is a net.Conn whose Write returns a scripted (n, err), so
+// send's zero-byte-vs-partial-write handling can be tested without a real
+// socket.
+type scriptedConn struct {
+	net.Conn
+	writeN   int
+	writeErr error
+	closed   atomic.Bool
+}
+
+func (s *scriptedConn) Write(b []byte) (int, error) {
+	return s.writeN, s.writeErr
+}
+
+func (s *scriptedConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (s *scriptedConn) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func TestSendLeavesConnOpenOnZeroByteWrite(t *testing.T) {
+	var c Client
+	conn := &scriptedConn{writeN: 0, writeErr: errors.New("i/o timeout")}
+	c.swapConn(conn)
+
+	if err := c.send(context.Background(), "/foo", ""); err == nil {
+		t.Fatal("expected send to return the write error")
+	}
+	if conn.closed.Load() {
+		t.Fatal("send closed conn on a zero-byte write failure")
+	}
+}
+
+func TestSendClosesConnOnPartialWrite(t *testing.T) {
+	var c Client
+	conn := &scriptedConn{writeN: 3, writeErr: errors.New("broken pipe")}
+	c.swapConn(conn)
+
+	if err := c.send(context.Background(), "/foo", ""); err == nil {
+		t.Fatal("expected send to return the write error")
+	}
+	if !conn.closed.Load() {
+		t.Fatal("send left conn open after a partial write")
+	}
+}
+
+func TestAppendSentenceWord(t *testing.T) {
+	var s sentence
+	s = appendSentenceWord(s, "!re")
+	s = appendSentenceWord(s, ".tag=7")
+	s = appendSentenceWord(s, "=name=ether1")
+	s = appendSentenceWord(s, "=type=ether")
+
+	if s.kind != "!re" {
+		t.Errorf("kind = %q, want !re", s.kind)
+	}
+	if s.tag != "7" {
+		t.Errorf("tag = %q, want 7", s.tag)
+	}
+	want := []Pair{{Key: "name", Value: "ether1"}, {Key: "type", Value: "ether"}}
+	if !reflect.DeepEqual(s.pairs, want) {
+		t.Errorf("pairs = %+v, want %+v", s.pairs, want)
+	}
+}